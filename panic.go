@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+)
+
+// PanicHandler renders the client response for a panic recovered while
+// serving r. err is the recovered value and stack is the stack trace
+// captured at the point of recovery.
+type PanicHandler func(w http.ResponseWriter, r *http.Request, err interface{}, stack []byte)
+
+// defaultPanicHandler returns the PanicHandler used when RecoverMux.PanicHandler
+// is unset, preserving the original "Something went wrong." response, with an
+// optional stack dump for backward compatibility with DumpStack.
+func defaultPanicHandler(dumpStack bool) PanicHandler {
+	return func(w http.ResponseWriter, r *http.Request, err interface{}, stack []byte) {
+		fmt.Fprintf(w, "Something went wrong.\n")
+		if dumpStack {
+			fmt.Fprintf(w, "\n")
+			w.Write(stack)
+		}
+	}
+}
+
+// TextPanicHandler renders a plain text "Something went wrong." response.
+func TextPanicHandler(w http.ResponseWriter, r *http.Request, err interface{}, stack []byte) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "Something went wrong.\n")
+}
+
+// JSONPanicHandler renders a JSON response of the form
+// {"error": "...", "request_id": "..."}. The request_id field is the
+// request's X-Request-Id header, or a generated ID if the client didn't send
+// one; see RequestID.
+func JSONPanicHandler(w http.ResponseWriter, r *http.Request, err interface{}, stack []byte) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(struct {
+		Error     string `json:"error"`
+		RequestID string `json:"request_id"`
+	}{
+		Error:     fmt.Sprint(err),
+		RequestID: RequestID(r.Context()),
+	})
+}
+
+// HTMLPanicHandler renders a minimal HTML error page.
+func HTMLPanicHandler(w http.ResponseWriter, r *http.Request, err interface{}, stack []byte) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, "<html><head><title>Something went wrong</title></head>"+
+		"<body><h1>Something went wrong.</h1><p>%s</p></body></html>\n",
+		html.EscapeString(fmt.Sprint(err)))
+}
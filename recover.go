@@ -1,26 +1,163 @@
 package main
 
 import (
-	"bytes"
-	"fmt"
 	"log"
 	"net/http"
 	"runtime/debug"
+	"sync"
 )
 
+// Recover returns an http.Handler middleware that recovers from panics
+// raised by next, buffering next's response so it can be discarded if a
+// panic occurs. Unlike RecoverMux, Recover is not tied to any particular
+// router and can be composed with any http.Handler-based mux (chi,
+// gorilla/mux, gin, or the stdlib http.ServeMux). opts configures the same
+// behavior RecoverMux's DumpStack, PanicHandler, ErrorLog, and StackFilter
+// fields do; see WithDumpStack, WithPanicHandler, WithErrorLog, and
+// WithStackFilter. Recover has no panic stats or PanicRateLimit.
+func Recover(next http.Handler, opts ...RecoverOption) http.Handler {
+	var cfg recoverConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return recoverMiddleware{handler: next, cfg: cfg}
+}
+
+// RecoverFunc is the http.HandlerFunc equivalent of Recover, for wrapping a
+// plain func(http.ResponseWriter, *http.Request) without first converting it
+// to an http.Handler.
+func RecoverFunc(next func(http.ResponseWriter, *http.Request), opts ...RecoverOption) http.Handler {
+	return Recover(http.HandlerFunc(next), opts...)
+}
+
+// A RecoverOption configures the recovery behavior of Recover, RecoverFunc,
+// or RecoverMux.
+type RecoverOption func(*recoverConfig)
+
+// WithDumpStack sets whether the default panic response includes the stack
+// trace, matching RecoverMux.DumpStack.
+func WithDumpStack(dump bool) RecoverOption {
+	return func(cfg *recoverConfig) {
+		cfg.dumpStack = dump
+	}
+}
+
+// WithPanicHandler sets the PanicHandler used to render the client response
+// for a recovered panic, matching RecoverMux.PanicHandler.
+func WithPanicHandler(ph PanicHandler) RecoverOption {
+	return func(cfg *recoverConfig) {
+		cfg.panicHandler = ph
+	}
+}
+
+// WithErrorLog sets the logger used to log recovered panics, matching
+// RecoverMux.ErrorLog. If unset, the standard log package is used.
+func WithErrorLog(l *log.Logger) RecoverOption {
+	return func(cfg *recoverConfig) {
+		cfg.errorLog = l
+	}
+}
+
+// WithStackFilter sets the StackFilter applied to a panic's stack trace
+// before it's dumped, passed to a PanicHandler, or recorded, matching
+// RecoverMux.StackFilter.
+func WithStackFilter(f StackFilter) RecoverOption {
+	return func(cfg *recoverConfig) {
+		cfg.stackFilter = f
+	}
+}
+
+// A recoverMiddleware wraps a handler with the RecoverMux recovery behavior.
+type recoverMiddleware struct {
+	handler http.Handler
+	cfg     recoverConfig
+}
+
+// ServeHTTP recovers from panics in the wrapped handler, sending an error
+// response to the client in the event a panic occurs.
+func (m recoverMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	serveRecoverable(w, r, m.handler, m.cfg)
+}
+
 // A RecoverMux recovers from panics during an http.Handler, sending an error
 // response to a client in the event a panic occurs.
 type RecoverMux struct {
 	mux *http.ServeMux
 
 	DumpStack bool // set to true to dump the stack to the client on a panic
+
+	// PanicHandler, if set, is called to render the client response when a
+	// handler panics, in place of the default "Something went wrong." body.
+	// See TextPanicHandler, JSONPanicHandler, and HTMLPanicHandler for
+	// built-in choices.
+	PanicHandler PanicHandler
+
+	// ErrorLog, if set, is used to log panics recovered by the mux,
+	// mirroring http.Server.ErrorLog. If nil, the standard log package is
+	// used instead.
+	ErrorLog *log.Logger
+
+	// PanicRateLimit, if set, trips a circuit breaker for a pattern once its
+	// panic rate crosses the configured threshold, short-circuiting further
+	// requests to that pattern with a 503 instead of re-invoking the
+	// crashing handler. See Stats for per-pattern panic counts.
+	PanicRateLimit *PanicRateLimit
+
+	// StackFilter, if set, is applied to a panic's stack trace before it is
+	// dumped to the client (when DumpStack is set), passed to PanicHandler,
+	// or recorded in Stats. See TrimRecoveryFrames for a filter that strips
+	// this package's own recovery frames. The raw stack is always used for
+	// ErrorLog/log output.
+	StackFilter StackFilter
+
+	mu    sync.Mutex
+	stats map[string]*routeStats
+	srv   *http.Server  // set by Serve/ListenAndServe; used by Shutdown
+	ready chan struct{} // closed once srv is set, so Shutdown can wait for it
 }
 
 // NewRecoverMux returns a new RecoverMux, creating and wrapping a new
-// http.ServeMux.
+// http.ServeMux. It also registers a debug handler at /debug/recover that
+// renders Stats as JSON.
 func NewRecoverMux() *RecoverMux {
-	return &RecoverMux{
-		mux: http.NewServeMux(),
+	rmux := &RecoverMux{
+		mux:   http.NewServeMux(),
+		stats: make(map[string]*routeStats),
+		ready: make(chan struct{}),
+	}
+	rmux.mux.Handle("/debug/recover", rmux.debugHandler())
+	return rmux
+}
+
+// Handle wraps h with the same recovery Recover applies, plus rmux's panic
+// stats and PanicRateLimit, and registers it with the wrapped
+// http.ServeMux, matching the stdlib http.ServeMux.Handle API.
+// Response data is only written if h completes without panicking.
+func (rmux *RecoverMux) Handle(pattern string, h http.Handler) {
+	rmux.mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		if rmux.PanicRateLimit != nil && rmux.circuitOpen(pattern) {
+			http.Error(w, "Service temporarily unavailable.", http.StatusServiceUnavailable)
+			return
+		}
+		var cfg recoverConfig
+		for _, opt := range rmux.options() {
+			opt(&cfg)
+		}
+		cfg.onPanic = func(err interface{}, stack []byte) {
+			rmux.recordPanic(pattern, stack)
+		}
+		serveRecoverable(w, r, h, cfg)
+	})
+}
+
+// options returns the RecoverOptions equivalent to rmux's exported fields, so
+// Handle can build its per-request recoverConfig the same way Recover does.
+func (rmux *RecoverMux) options() []RecoverOption {
+	return []RecoverOption{
+		WithDumpStack(rmux.DumpStack),
+		WithPanicHandler(rmux.PanicHandler),
+		WithErrorLog(rmux.ErrorLog),
+		WithStackFilter(rmux.StackFilter),
 	}
 }
 
@@ -28,22 +165,7 @@ func NewRecoverMux() *RecoverMux {
 // from panics in the caller's handler. Response data is only written if the
 // caller's handler completes without panicking.
 func (rmux *RecoverMux) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
-	f := func(w http.ResponseWriter, r *http.Request) {
-		defer func() {
-			if x := recover(); x != nil {
-				rmux.recoverHandler(w, r)
-			}
-		}()
-		// Use a responseWriter to buffer the user's handler's response
-		// so it can be thrown away in the event of a panic.
-		rw := newResponseWriter(w)
-		handler(rw, r)
-		err := rw.complete()
-		if err != nil {
-			log.Printf("error completing handler (URL %s): %s", r.URL, err.Error())
-		}
-	}
-	rmux.mux.HandleFunc(pattern, f)
+	rmux.Handle(pattern, http.HandlerFunc(handler))
 }
 
 // ServeHTTP uses the wrapped http.ServeMux to serve recoverable handlers.
@@ -51,60 +173,68 @@ func (rmux *RecoverMux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	rmux.mux.ServeHTTP(w, r)
 }
 
-// RecoverHandler is the handler invoked when the client's handler panics.
-func (rmux *RecoverMux) recoverHandler(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(w, "Something went wrong.\n")
+// recoverConfig holds the per-request settings serveRecoverable needs to
+// render and log a recovered panic.
+type recoverConfig struct {
+	dumpStack    bool
+	panicHandler PanicHandler
+	errorLog     *log.Logger
+	stackFilter  StackFilter
+	onPanic      func(err interface{}, stack []byte)
+}
 
-	if rmux.DumpStack {
-		s := debug.Stack()
-		fmt.Fprintf(w, "\n")
-		w.Write(s)
+// logf logs a recovered panic using cfg.errorLog if set, falling back to the
+// standard log package otherwise, mirroring http.Server.ErrorLog.
+func (cfg recoverConfig) logf(format string, args ...interface{}) {
+	if cfg.errorLog != nil {
+		cfg.errorLog.Printf(format, args...)
+		return
 	}
+	log.Printf(format, args...)
 }
 
-// A responseWriter wraps http.ResponseWriter for a recoverMux.
-type responseWriter struct {
-	buf *bytes.Buffer
-	sc  int
-	w   http.ResponseWriter
-}
+// serveRecoverable invokes h with a buffered responseWriter, recovering from
+// any panic and sending an error response instead of h's (discarded) output.
+func serveRecoverable(w http.ResponseWriter, r *http.Request, h http.Handler, cfg recoverConfig) {
+	// Attach a request ID to the request context so downstream handlers and
+	// this package's own log lines can correlate, before the deferred
+	// recover below closes over r.
+	r = withRequestID(r)
 
-// NewResponseWriter returns a new responseWriter for an http.ResponseWriter
-// for passing to a real handler by the recoverMux's handler.
-func newResponseWriter(w http.ResponseWriter) *responseWriter {
-	return &responseWriter{
-		buf: &bytes.Buffer{},
-		sc:  -1, // Flag value to indicate it has not been written
-		w:   w,
+	defer func() {
+		if x := recover(); x != nil {
+			recoverHandler(w, r, x, cfg)
+		}
+	}()
+	// Use a responseWriter to buffer the handler's response so it can be
+	// thrown away in the event of a panic.
+	base := newResponseWriter(w)
+	h.ServeHTTP(wrapResponseWriter(base), r)
+	err := base.complete()
+	if err != nil {
+		cfg.logf("error completing handler (URL %s): %s", r.URL, err.Error())
 	}
 }
 
-// Header simply returns the real http.ResponseWriter's Header.
-func (w *responseWriter) Header() http.Header {
-	return w.w.Header()
-}
+// recoverHandler is invoked when a wrapped handler panics. It logs the panic
+// and renders a client response using cfg.panicHandler, falling back to the
+// default "Something went wrong." body (honoring cfg.dumpStack) if unset.
+func recoverHandler(w http.ResponseWriter, r *http.Request, err interface{}, cfg recoverConfig) {
+	stack := debug.Stack()
+	cfg.logf("panic serving %s %s (remote %s, request_id %s): %v\n%s",
+		r.Method, r.URL, r.RemoteAddr, RequestID(r.Context()), err, stack)
 
-// Write buffers response writes so the recoverMux can throw them away in case
-// the real handler panics.
-func (w *responseWriter) Write(p []byte) (int, error) {
-	return w.buf.Write(p)
-}
+	if cfg.stackFilter != nil {
+		stack = cfg.stackFilter(stack)
+	}
 
-// WriteHeader saves the status code from the real handler so it can be thrown
-// away if the real handler panics. It panics if the code is not valid.
-func (w *responseWriter) WriteHeader(statusCode int) {
-	if statusCode < 100 || statusCode > 999 {
-		panic(fmt.Sprintf("invalid WriteHeader code %v", statusCode))
+	if cfg.onPanic != nil {
+		cfg.onPanic(err, stack)
 	}
-	w.sc = statusCode
-}
 
-// Complete sends the full response to the client in cases where the real
-// handler completes without panicking.
-func (w *responseWriter) complete() error {
-	if w.sc > 0 {
-		w.w.WriteHeader(w.sc)
+	ph := cfg.panicHandler
+	if ph == nil {
+		ph = defaultPanicHandler(cfg.dumpStack)
 	}
-	_, err := w.w.Write(w.buf.Bytes())
-	return err
+	ph(w, r, err, stack)
 }
@@ -2,9 +2,12 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"math/rand"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
 	"time"
@@ -16,13 +19,32 @@ type testHandler interface {
 	desc() string
 }
 
+// startServer starts h on an ephemeral localhost port and returns its base
+// URL and a func that gracefully shuts it down, so each test gets its own
+// port and can run in parallel.
+func startServer(t *testing.T, h http.Handler) (string, func()) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error %s", err.Error())
+	}
+	s := &http.Server{Handler: h}
+	go s.Serve(l)
+	return "http://" + l.Addr().String(), func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := s.Shutdown(ctx); err != nil {
+			t.Errorf("server shutdown error %s", err.Error())
+		}
+	}
+}
+
 // TestRecoverMux tests the default, production-like behavior of the
 // recoverMux. Ensures normal and panicking client handlers work as expected.
 func TestRecoverMux(t *testing.T) {
-	// Some server URL stuff
-	addr := ":5050"
+	t.Parallel()
+
 	path := "/test"
-	url := "http://localhost" + addr + path
 
 	// Test table of handlers
 	ths := []testHandler{
@@ -35,22 +57,19 @@ func TestRecoverMux(t *testing.T) {
 
 	// Run each test in the table
 	for _, th := range ths {
-		// Create recoverMux under test
+		th := th
 		t.Run(fmt.Sprintf("TestRecoverMux %s", th.desc()), func(t *testing.T) {
+			t.Parallel()
+
 			mux := NewRecoverMux()
 			mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
 				th.Handle(w, r)
 			})
-			s := &http.Server{
-				Addr:    addr,
-				Handler: mux,
-			}
-
-			// Start server
-			go s.ListenAndServe()
+			base, shutdown := startServer(t, mux)
+			defer shutdown()
 
 			// Get response from server
-			resp, err := http.Get(url)
+			resp, err := http.Get(base + path)
 
 			// Ensure normal response
 			if err != nil {
@@ -78,12 +97,6 @@ func TestRecoverMux(t *testing.T) {
 			}
 
 			resp.Body.Close()
-
-			// Close server
-			err = s.Close()
-			if err != nil {
-				t.Errorf("server close error %s", err.Error())
-			}
 		})
 	}
 }
@@ -91,10 +104,9 @@ func TestRecoverMux(t *testing.T) {
 // TestDebugOKRecoverMux tests behavior of the recoverMux with the DumpStack
 // flag set to true for a normal client handler.
 func TestDebugOKRecoverMux(t *testing.T) {
-	// Some server URL stuff
-	addr := ":5050"
+	t.Parallel()
+
 	path := "/test"
-	url := "http://localhost" + addr + path
 
 	// Test normal handler
 	th := newTestHandlerOK("good path")
@@ -103,13 +115,10 @@ func TestDebugOKRecoverMux(t *testing.T) {
 	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
 		th.Handle(w, r)
 	})
-	s := &http.Server{
-		Addr:    addr,
-		Handler: mux,
-	}
-	go s.ListenAndServe()
+	base, shutdown := startServer(t, mux)
+	defer shutdown()
 
-	resp, err := http.Get(url)
+	resp, err := http.Get(base + path)
 	if err != nil {
 		t.Errorf("HTTP GET error %s\n", err.Error())
 		return
@@ -134,20 +143,14 @@ func TestDebugOKRecoverMux(t *testing.T) {
 	}
 
 	resp.Body.Close()
-
-	err = s.Close()
-	if err != nil {
-		t.Errorf("server close error %s", err.Error())
-	}
 }
 
 // TestDebugPanicRecoverMux tests behavior of the recoverMux with the DumpStack
 // flag set to true for a panicking client handler.
 func TestDebugPanicRecoverMux(t *testing.T) {
-	// Some server URL stuff
-	addr := ":5050"
+	t.Parallel()
+
 	path := "/test"
-	url := "http://localhost" + addr + path
 
 	// Test normal handler
 	th := newTestHandlerPanic("panicking with stack")
@@ -156,13 +159,10 @@ func TestDebugPanicRecoverMux(t *testing.T) {
 	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
 		th.Handle(w, r)
 	})
-	s := &http.Server{
-		Addr:    addr,
-		Handler: mux,
-	}
-	go s.ListenAndServe()
+	base, shutdown := startServer(t, mux)
+	defer shutdown()
 
-	resp, err := http.Get(url)
+	resp, err := http.Get(base + path)
 	if err != nil {
 		t.Errorf("HTTP GET error %s\n", err.Error())
 		return
@@ -219,11 +219,628 @@ func TestDebugPanicRecoverMux(t *testing.T) {
 	}
 
 	resp.Body.Close()
+}
+
+// TestRecoverMiddleware tests Recover composed directly with a stdlib
+// http.ServeMux, independent of RecoverMux.
+func TestRecoverMiddleware(t *testing.T) {
+	t.Parallel()
+
+	path := "/test"
+
+	ths := []testHandler{
+		newTestHandlerOK("good path"),
+		newTestHandlerPanic("panic message"),
+	}
+
+	for _, th := range ths {
+		th := th
+		t.Run(fmt.Sprintf("Recover %s", th.desc()), func(t *testing.T) {
+			t.Parallel()
+
+			mux := http.NewServeMux()
+			mux.Handle(path, Recover(http.HandlerFunc(th.Handle)))
+			base, shutdown := startServer(t, mux)
+			defer shutdown()
+
+			resp, err := http.Get(base + path)
+			if err != nil {
+				t.Errorf("HTTP GET error %s\n", err.Error())
+				return
+			}
+
+			sc := bufio.NewScanner(resp.Body)
+			b := sc.Scan()
+			if !b {
+				t.Errorf("unexpected EOF")
+			} else if ln := sc.Text(); ln != th.response() {
+				t.Errorf("response mismatch actual \"%s\" expected \"%s\"",
+					ln, th.response())
+			}
+
+			resp.Body.Close()
+		})
+	}
+}
+
+// TestRecoverMuxHandle tests that RecoverMux.Handle registers a plain
+// http.Handler the same way HandleFunc registers a handler func.
+func TestRecoverMuxHandle(t *testing.T) {
+	t.Parallel()
 
-	// Close server
-	err = s.Close()
+	path := "/test"
+
+	th := newTestHandlerOK("good path")
+	mux := NewRecoverMux()
+	mux.Handle(path, http.HandlerFunc(th.Handle))
+	base, shutdown := startServer(t, mux)
+	defer shutdown()
+
+	resp, err := http.Get(base + path)
 	if err != nil {
-		t.Errorf("test error: %s close error %s", th.desc(), err.Error())
+		t.Errorf("HTTP GET error %s\n", err.Error())
+		return
+	}
+
+	sc := bufio.NewScanner(resp.Body)
+	b := sc.Scan()
+	if !b {
+		t.Errorf("unexpected EOF")
+	} else if ln := sc.Text(); ln != th.response() {
+		t.Errorf("response mismatch actual \"%s\" expected \"%s\"",
+			ln, th.response())
+	}
+
+	resp.Body.Close()
+}
+
+// TestRecoverMuxPanicHandler tests that a configured PanicHandler is used in
+// place of the default "Something went wrong." response.
+func TestRecoverMuxPanicHandler(t *testing.T) {
+	t.Parallel()
+
+	path := "/test"
+
+	th := newTestHandlerPanic("boom")
+	mux := NewRecoverMux()
+	mux.PanicHandler = JSONPanicHandler
+	mux.HandleFunc(path, th.Handle)
+	base, shutdown := startServer(t, mux)
+	defer shutdown()
+
+	resp, err := http.Get(base + path)
+	if err != nil {
+		t.Errorf("HTTP GET error %s\n", err.Error())
+		return
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		t.Errorf("Content-Type mismatch: %s", ct)
+	}
+
+	sc := bufio.NewScanner(resp.Body)
+	if !sc.Scan() {
+		t.Errorf("unexpected EOF")
+	} else if ln := sc.Text(); !strings.Contains(ln, `"error"`) || !strings.Contains(ln, "boom") {
+		t.Errorf("unexpected JSON body: %s", ln)
+	}
+}
+
+// TestBuiltinPanicHandlers tests the built-in TextPanicHandler,
+// JSONPanicHandler, and HTMLPanicHandler directly.
+func TestBuiltinPanicHandlers(t *testing.T) {
+	t.Parallel()
+
+	r := httptest.NewRequest("GET", "/test", nil)
+	r.Header.Set("X-Request-Id", "abc123")
+	r = withRequestID(r)
+
+	t.Run("TextPanicHandler", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		TextPanicHandler(w, r, "boom", nil)
+		if body := w.Body.String(); body != "Something went wrong.\n" {
+			t.Errorf("body mismatch: %q", body)
+		}
+	})
+
+	t.Run("JSONPanicHandler", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		JSONPanicHandler(w, r, "boom", nil)
+		want := `{"error":"boom","request_id":"abc123"}` + "\n"
+		if body := w.Body.String(); body != want {
+			t.Errorf("body mismatch: got %q want %q", body, want)
+		}
+	})
+
+	t.Run("HTMLPanicHandler", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		HTMLPanicHandler(w, r, "<boom>", nil)
+		if body := w.Body.String(); !strings.Contains(body, "&lt;boom&gt;") {
+			t.Errorf("body not escaped: %q", body)
+		}
+	})
+}
+
+// TestResponseWriterFlush tests that wrapResponseWriter returns a writer
+// that only advertises the extra interfaces its underlying writer supports,
+// and that Flush commits the buffered response and switches to pass-through.
+func TestResponseWriterFlush(t *testing.T) {
+	t.Parallel()
+
+	rec := httptest.NewRecorder()
+	base := newResponseWriter(rec)
+	rw := wrapResponseWriter(base)
+
+	fl, ok := rw.(http.Flusher)
+	if !ok {
+		t.Fatalf("expected rw to implement http.Flusher")
+	}
+	if _, ok := rw.(http.Hijacker); ok {
+		t.Errorf("expected rw not to implement http.Hijacker for a plain ResponseRecorder")
+	}
+
+	rw.WriteHeader(201)
+	fmt.Fprintf(rw, "first")
+	fl.Flush()
+	fmt.Fprintf(rw, "second")
+
+	if rec.Code != 201 {
+		t.Errorf("status code mismatch: %d", rec.Code)
+	}
+	if body := rec.Body.String(); body != "firstsecond" {
+		t.Errorf("body mismatch: %q", body)
+	}
+	if err := base.complete(); err != nil {
+		t.Errorf("complete error after flush: %s", err)
+	}
+}
+
+// fakeBaseRW is the http.ResponseWriter embedded by every fake writer
+// combination below; it implements only the three required methods.
+type fakeBaseRW struct {
+	header http.Header
+}
+
+func (f *fakeBaseRW) Header() http.Header {
+	if f.header == nil {
+		f.header = http.Header{}
+	}
+	return f.header
+}
+
+func (f *fakeBaseRW) Write(p []byte) (int, error) { return len(p), nil }
+
+func (f *fakeBaseRW) WriteHeader(int) {}
+
+// fakeFlusher, fakeHijacker, fakePusher, and fakeCloseNotifier are embedded
+// piecewise into the combination types below so each combination's method
+// set exactly matches the interfaces it's meant to advertise, tracking
+// whether the underlying method was actually invoked.
+type fakeFlusher struct{ called *bool }
+
+func (f fakeFlusher) Flush() { *f.called = true }
+
+type fakeHijacker struct{ called *bool }
+
+func (f fakeHijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	*f.called = true
+	return nil, nil, nil
+}
+
+type fakePusher struct{ called *bool }
+
+func (f fakePusher) Push(target string, opts *http.PushOptions) error {
+	*f.called = true
+	return nil
+}
+
+type fakeCloseNotifier struct{ called *bool }
+
+func (f fakeCloseNotifier) CloseNotify() <-chan bool {
+	*f.called = true
+	return make(chan bool)
+}
+
+type fakeRW_FL struct {
+	*fakeBaseRW
+	fakeFlusher
+}
+type fakeRW_HJ struct {
+	*fakeBaseRW
+	fakeHijacker
+}
+type fakeRW_PS struct {
+	*fakeBaseRW
+	fakePusher
+}
+type fakeRW_CN struct {
+	*fakeBaseRW
+	fakeCloseNotifier
+}
+type fakeRW_FL_HJ struct {
+	*fakeBaseRW
+	fakeFlusher
+	fakeHijacker
+}
+type fakeRW_FL_PS struct {
+	*fakeBaseRW
+	fakeFlusher
+	fakePusher
+}
+type fakeRW_HJ_PS struct {
+	*fakeBaseRW
+	fakeHijacker
+	fakePusher
+}
+type fakeRW_FL_HJ_PS struct {
+	*fakeBaseRW
+	fakeFlusher
+	fakeHijacker
+	fakePusher
+}
+type fakeRW_FL_CN struct {
+	*fakeBaseRW
+	fakeFlusher
+	fakeCloseNotifier
+}
+type fakeRW_HJ_CN struct {
+	*fakeBaseRW
+	fakeHijacker
+	fakeCloseNotifier
+}
+type fakeRW_PS_CN struct {
+	*fakeBaseRW
+	fakePusher
+	fakeCloseNotifier
+}
+type fakeRW_FL_HJ_CN struct { // http1ResponseWriter shape
+	*fakeBaseRW
+	fakeFlusher
+	fakeHijacker
+	fakeCloseNotifier
+}
+type fakeRW_FL_PS_CN struct { // http2ResponseWriter shape
+	*fakeBaseRW
+	fakeFlusher
+	fakePusher
+	fakeCloseNotifier
+}
+type fakeRW_HJ_PS_CN struct {
+	*fakeBaseRW
+	fakeHijacker
+	fakePusher
+	fakeCloseNotifier
+}
+type fakeRW_FL_HJ_PS_CN struct { // fullResponseWriter shape
+	*fakeBaseRW
+	fakeFlusher
+	fakeHijacker
+	fakePusher
+	fakeCloseNotifier
+}
+
+// TestWrapResponseWriterCombinations tests that wrapResponseWriter returns a
+// writer advertising exactly the http.Flusher/http.Hijacker/http.Pusher/
+// http.CloseNotifier combination the underlying writer supports, for all 16
+// possible combinations, and that each supported method actually forwards
+// to the underlying writer rather than being silently dropped.
+func TestWrapResponseWriterCombinations(t *testing.T) {
+	t.Parallel()
+
+	var flCalled, hjCalled, psCalled, cnCalled bool
+	newFlags := func() (*bool, *bool, *bool, *bool) {
+		flCalled, hjCalled, psCalled, cnCalled = false, false, false, false
+		return &flCalled, &hjCalled, &psCalled, &cnCalled
+	}
+
+	cases := []struct {
+		desc           string
+		fl, hj, ps, cn bool
+		makeUnderlying func() http.ResponseWriter
+	}{
+		{"none", false, false, false, false, func() http.ResponseWriter {
+			return &fakeBaseRW{}
+		}},
+		{"fl", true, false, false, false, func() http.ResponseWriter {
+			fl, _, _, _ := newFlags()
+			return fakeRW_FL{&fakeBaseRW{}, fakeFlusher{fl}}
+		}},
+		{"hj", false, true, false, false, func() http.ResponseWriter {
+			_, hj, _, _ := newFlags()
+			return fakeRW_HJ{&fakeBaseRW{}, fakeHijacker{hj}}
+		}},
+		{"ps", false, false, true, false, func() http.ResponseWriter {
+			_, _, ps, _ := newFlags()
+			return fakeRW_PS{&fakeBaseRW{}, fakePusher{ps}}
+		}},
+		{"cn", false, false, false, true, func() http.ResponseWriter {
+			_, _, _, cn := newFlags()
+			return fakeRW_CN{&fakeBaseRW{}, fakeCloseNotifier{cn}}
+		}},
+		{"fl,hj", true, true, false, false, func() http.ResponseWriter {
+			fl, hj, _, _ := newFlags()
+			return fakeRW_FL_HJ{&fakeBaseRW{}, fakeFlusher{fl}, fakeHijacker{hj}}
+		}},
+		{"fl,ps", true, false, true, false, func() http.ResponseWriter {
+			fl, _, ps, _ := newFlags()
+			return fakeRW_FL_PS{&fakeBaseRW{}, fakeFlusher{fl}, fakePusher{ps}}
+		}},
+		{"hj,ps", false, true, true, false, func() http.ResponseWriter {
+			_, hj, ps, _ := newFlags()
+			return fakeRW_HJ_PS{&fakeBaseRW{}, fakeHijacker{hj}, fakePusher{ps}}
+		}},
+		{"fl,hj,ps", true, true, true, false, func() http.ResponseWriter {
+			fl, hj, ps, _ := newFlags()
+			return fakeRW_FL_HJ_PS{&fakeBaseRW{}, fakeFlusher{fl}, fakeHijacker{hj}, fakePusher{ps}}
+		}},
+		{"fl,cn", true, false, false, true, func() http.ResponseWriter {
+			fl, _, _, cn := newFlags()
+			return fakeRW_FL_CN{&fakeBaseRW{}, fakeFlusher{fl}, fakeCloseNotifier{cn}}
+		}},
+		{"hj,cn", false, true, false, true, func() http.ResponseWriter {
+			_, hj, _, cn := newFlags()
+			return fakeRW_HJ_CN{&fakeBaseRW{}, fakeHijacker{hj}, fakeCloseNotifier{cn}}
+		}},
+		{"ps,cn", false, false, true, true, func() http.ResponseWriter {
+			_, _, ps, cn := newFlags()
+			return fakeRW_PS_CN{&fakeBaseRW{}, fakePusher{ps}, fakeCloseNotifier{cn}}
+		}},
+		{"fl,hj,cn (http1)", true, true, false, true, func() http.ResponseWriter {
+			fl, hj, _, cn := newFlags()
+			return fakeRW_FL_HJ_CN{&fakeBaseRW{}, fakeFlusher{fl}, fakeHijacker{hj}, fakeCloseNotifier{cn}}
+		}},
+		{"fl,ps,cn (http2)", true, false, true, true, func() http.ResponseWriter {
+			fl, _, ps, cn := newFlags()
+			return fakeRW_FL_PS_CN{&fakeBaseRW{}, fakeFlusher{fl}, fakePusher{ps}, fakeCloseNotifier{cn}}
+		}},
+		{"hj,ps,cn", false, true, true, true, func() http.ResponseWriter {
+			_, hj, ps, cn := newFlags()
+			return fakeRW_HJ_PS_CN{&fakeBaseRW{}, fakeHijacker{hj}, fakePusher{ps}, fakeCloseNotifier{cn}}
+		}},
+		{"fl,hj,ps,cn (full)", true, true, true, true, func() http.ResponseWriter {
+			fl, hj, ps, cn := newFlags()
+			return fakeRW_FL_HJ_PS_CN{&fakeBaseRW{}, fakeFlusher{fl}, fakeHijacker{hj}, fakePusher{ps}, fakeCloseNotifier{cn}}
+		}},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.desc, func(t *testing.T) {
+			base := newResponseWriter(c.makeUnderlying())
+			rw := wrapResponseWriter(base)
+
+			if fl, ok := rw.(http.Flusher); ok != c.fl {
+				t.Errorf("Flusher support: got %v want %v", ok, c.fl)
+			} else if ok {
+				fl.Flush()
+				if !flCalled {
+					t.Errorf("Flush did not forward to the underlying writer")
+				}
+			}
+
+			if hj, ok := rw.(http.Hijacker); ok != c.hj {
+				t.Errorf("Hijacker support: got %v want %v", ok, c.hj)
+			} else if ok {
+				hj.Hijack()
+				if !hjCalled {
+					t.Errorf("Hijack did not forward to the underlying writer")
+				}
+			}
+
+			if ps, ok := rw.(http.Pusher); ok != c.ps {
+				t.Errorf("Pusher support: got %v want %v", ok, c.ps)
+			} else if ok {
+				ps.Push("/x", nil)
+				if !psCalled {
+					t.Errorf("Push did not forward to the underlying writer")
+				}
+			}
+
+			if cn, ok := rw.(http.CloseNotifier); ok != c.cn {
+				t.Errorf("CloseNotifier support: got %v want %v", ok, c.cn)
+			} else if ok {
+				cn.CloseNotify()
+				if !cnCalled {
+					t.Errorf("CloseNotify did not forward to the underlying writer")
+				}
+			}
+		})
+	}
+}
+
+// TestRecoverMuxStats tests that Stats tracks per-pattern panic counts and
+// the last panic's time and stack.
+func TestRecoverMuxStats(t *testing.T) {
+	t.Parallel()
+
+	path := "/test"
+
+	th := newTestHandlerPanic("stats boom")
+	mux := NewRecoverMux()
+	mux.HandleFunc(path, th.Handle)
+	base, shutdown := startServer(t, mux)
+	defer shutdown()
+
+	for i := 0; i < 3; i++ {
+		resp, err := http.Get(base + path)
+		if err != nil {
+			t.Fatalf("HTTP GET error %s\n", err.Error())
+		}
+		resp.Body.Close()
+	}
+
+	stats := mux.Stats()
+	if stats.Total != 3 {
+		t.Errorf("Total mismatch: got %d want 3", stats.Total)
+	}
+	if stats.Patterns[path] != 3 {
+		t.Errorf("Patterns[%s] mismatch: got %d want 3", path, stats.Patterns[path])
+	}
+	if stats.LastPanicTime.IsZero() {
+		t.Errorf("expected non-zero LastPanicTime")
+	}
+	if !strings.Contains(stats.LastStack, "goroutine") {
+		t.Errorf("expected LastStack to contain a stack trace")
+	}
+}
+
+// TestRecoverMuxPanicRateLimit tests that the circuit breaker trips after
+// enough panics within the window and short-circuits with a 503 during the
+// cool-down, without invoking the handler again.
+func TestRecoverMuxPanicRateLimit(t *testing.T) {
+	t.Parallel()
+
+	path := "/test"
+
+	var calls int
+	mux := NewRecoverMux()
+	mux.PanicRateLimit = &PanicRateLimit{
+		Threshold: 2,
+		Window:    time.Minute,
+		CoolDown:  time.Minute,
+	}
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		panic("rate limited boom")
+	})
+	base, shutdown := startServer(t, mux)
+	defer shutdown()
+
+	for i := 0; i < 2; i++ {
+		resp, err := http.Get(base + path)
+		if err != nil {
+			t.Fatalf("HTTP GET error %s\n", err.Error())
+		}
+		resp.Body.Close()
+	}
+
+	resp, err := http.Get(base + path)
+	if err != nil {
+		t.Fatalf("HTTP GET error %s\n", err.Error())
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("status code mismatch: got %d want %d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+	resp.Body.Close()
+
+	if calls != 2 {
+		t.Errorf("expected handler to be called 2 times before tripping, got %d", calls)
+	}
+}
+
+// TestRecoverMuxRequestID tests that the request ID is threaded through to
+// the wrapped handler via context, honoring an incoming X-Request-Id header
+// and generating one otherwise.
+func TestRecoverMuxRequestID(t *testing.T) {
+	t.Parallel()
+
+	path := "/test"
+
+	var seen string
+	mux := NewRecoverMux()
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		seen = RequestID(r.Context())
+		fmt.Fprint(w, "ok")
+	})
+	base, shutdown := startServer(t, mux)
+	defer shutdown()
+
+	req, err := http.NewRequest("GET", base+path, nil)
+	if err != nil {
+		t.Fatalf("NewRequest error %s", err.Error())
+	}
+	req.Header.Set("X-Request-Id", "client-supplied-id")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("HTTP GET error %s\n", err.Error())
+	}
+	resp.Body.Close()
+	if seen != "client-supplied-id" {
+		t.Errorf("request ID mismatch: got %q want %q", seen, "client-supplied-id")
+	}
+
+	resp, err = http.Get(base + path)
+	if err != nil {
+		t.Fatalf("HTTP GET error %s\n", err.Error())
+	}
+	resp.Body.Close()
+	if seen == "" {
+		t.Errorf("expected a generated request ID when none was supplied")
+	}
+}
+
+// TestTrimRecoveryFrames tests that TrimRecoveryFrames removes this
+// package's recovery frames while leaving other frames intact.
+func TestTrimRecoveryFrames(t *testing.T) {
+	t.Parallel()
+
+	stack := []byte(
+		"goroutine 1 [running]:\n" +
+			"runtime.gopanic(...)\n" +
+			"\t/usr/local/go/src/runtime/panic.go:100\n" +
+			"main.recoverHandler(...)\n" +
+			"\t/root/module/recover.go:150\n" +
+			"main.serveRecoverable.func1()\n" +
+			"\t/root/module/recover.go:135\n" +
+			"main.(*testHandlerPanic).Handle(...)\n" +
+			"\t/root/module/recover_test.go:250\n")
+
+	trimmed := string(TrimRecoveryFrames(stack))
+	for _, want := range []string{"gopanic", "recoverHandler", "func1"} {
+		if strings.Contains(trimmed, want) {
+			t.Errorf("expected %q to be trimmed from stack, got %s", want, trimmed)
+		}
+	}
+	if !strings.Contains(trimmed, "testHandlerPanic") {
+		t.Errorf("expected application frame to survive trimming, got %s", trimmed)
+	}
+}
+
+// TestRecoverMuxServeAndShutdown tests RecoverMux's own Serve and Shutdown
+// convenience methods, so callers don't need to embed an
+// *http.Server themselves.
+func TestRecoverMuxServeAndShutdown(t *testing.T) {
+	t.Parallel()
+
+	path := "/test"
+	th := newTestHandlerOK("good path")
+	mux := NewRecoverMux()
+	mux.HandleFunc(path, th.Handle)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error %s", err.Error())
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- mux.Serve(l)
+	}()
+
+	base := "http://" + l.Addr().String()
+	resp, err := http.Get(base + path)
+	if err != nil {
+		t.Fatalf("HTTP GET error %s\n", err.Error())
+	}
+	sc := bufio.NewScanner(resp.Body)
+	if !sc.Scan() || sc.Text() != th.response() {
+		t.Errorf("response mismatch")
+	}
+	resp.Body.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := mux.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown error %s", err.Error())
+	}
+
+	if err := <-serveErr; err != http.ErrServerClosed {
+		t.Errorf("Serve error mismatch: got %v want %v", err, http.ErrServerClosed)
+	}
+
+	if _, err := http.Get(base + path); err == nil {
+		t.Errorf("expected GET to fail after Shutdown")
 	}
 }
 
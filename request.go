@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// requestIDContextKey is the context key used to thread a request ID through
+// to downstream handlers and log lines.
+type requestIDContextKey struct{}
+
+// RequestID returns the request ID Recover or RecoverMux associated with ctx,
+// or "" if none is present.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey{}).(string)
+	return id
+}
+
+// withRequestID returns r with a request ID attached to its context: the
+// X-Request-Id header if the client sent one, otherwise a newly generated
+// one.
+func withRequestID(r *http.Request) *http.Request {
+	id := r.Header.Get("X-Request-Id")
+	if id == "" {
+		id = newRequestID()
+	}
+	return r.WithContext(context.WithValue(r.Context(), requestIDContextKey{}, id))
+}
+
+// newRequestID returns a random, UUID-like identifier. It isn't a
+// spec-compliant UUID since this package has no external dependencies, but
+// it's random enough to correlate a single request's log lines.
+func newRequestID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		// crypto/rand failing is effectively unrecoverable; fall back to a
+		// timestamp so request correlation keeps working.
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// StackFilter trims a captured stack trace, e.g. to remove this package's own
+// recovery frames before it's shown to a client, passed to a PanicHandler, or
+// recorded in Stats. The logged stack is never filtered.
+type StackFilter func(stack []byte) []byte
+
+// recoveryFrameMarkers identifies the stack frames this package's own
+// recovery path adds to every captured stack trace.
+var recoveryFrameMarkers = [][]byte{
+	[]byte("runtime/debug.Stack("),
+	[]byte("runtime.gopanic("),
+	[]byte("recoverHandler("),
+	[]byte(".func1("),
+}
+
+// TrimRecoveryFrames is a StackFilter that removes the runtime/debug.Stack,
+// runtime.gopanic (printed as "panic(...)"), recoverHandler, and wrapper
+// closure frames this package adds to every captured stack trace, keeping
+// the frames of the panicking handler and its callers. It matches on
+// function names line-by-line, so it may also trim an application frame
+// that happens to be named the same way.
+func TrimRecoveryFrames(stack []byte) []byte {
+	lines := bytes.Split(stack, []byte("\n"))
+	out := make([][]byte, 0, len(lines))
+	skipNext := false
+	for _, ln := range lines {
+		if skipNext {
+			skipNext = false
+			continue
+		}
+		if isRecoveryFrame(ln) {
+			skipNext = true // also drop the following file:line source line
+			continue
+		}
+		out = append(out, ln)
+	}
+	return bytes.Join(out, []byte("\n"))
+}
+
+func isRecoveryFrame(line []byte) bool {
+	// The runtime prints runtime.gopanic's frame as "panic(...)".
+	if bytes.HasPrefix(line, []byte("panic(")) {
+		return true
+	}
+	for _, marker := range recoveryFrameMarkers {
+		if bytes.Contains(line, marker) {
+			return true
+		}
+	}
+	return false
+}
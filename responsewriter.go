@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// A responseWriter wraps http.ResponseWriter, buffering writes so they can be
+// thrown away in the event of a panic. wrapResponseWriter returns it wrapped
+// in one of a combinatorial set of concrete types so that it only satisfies
+// http.Flusher, http.Hijacker, http.Pusher, and http.CloseNotifier when the
+// underlying http.ResponseWriter does, mirroring the technique used by
+// httputil.ReverseProxy and the httpsnoop package.
+type responseWriter struct {
+	buf *bytes.Buffer
+	sc  int
+	w   http.ResponseWriter
+
+	flushed bool // set once Flush has committed the buffer and gone pass-through
+}
+
+// newResponseWriter returns a new responseWriter for an http.ResponseWriter
+// for passing to a real handler by the recoverMux's handler.
+func newResponseWriter(w http.ResponseWriter) *responseWriter {
+	return &responseWriter{
+		buf: &bytes.Buffer{},
+		sc:  -1, // Flag value to indicate it has not been written
+		w:   w,
+	}
+}
+
+// wrapResponseWriter returns an http.ResponseWriter backed by rw that
+// additionally implements whichever of http.Flusher, http.Hijacker,
+// http.Pusher, and http.CloseNotifier the writer rw was built from supports.
+// All 16 combinations of the four interfaces are handled explicitly (as
+// httpsnoop does), rather than special-casing only the shapes real stdlib
+// connections present, so a non-stdlib http.ResponseWriter's capabilities
+// are never silently dropped.
+func wrapResponseWriter(rw *responseWriter) http.ResponseWriter {
+	_, fl := rw.w.(http.Flusher)
+	_, hj := rw.w.(http.Hijacker)
+	_, ps := rw.w.(http.Pusher)
+	_, cn := rw.w.(http.CloseNotifier)
+
+	// Index by bit: fl=1, hj=2, ps=4, cn=8.
+	idx := 0
+	if fl {
+		idx |= 1
+	}
+	if hj {
+		idx |= 2
+	}
+	if ps {
+		idx |= 4
+	}
+	if cn {
+		idx |= 8
+	}
+
+	switch idx {
+	case 0:
+		return rw
+	case 1:
+		return flusherResponseWriter{rw}
+	case 2:
+		return hijackerResponseWriter{rw}
+	case 3:
+		return flusherHijackerResponseWriter{rw}
+	case 4:
+		return pusherResponseWriter{rw}
+	case 5:
+		return flusherPusherResponseWriter{rw}
+	case 6:
+		return hijackerPusherResponseWriter{rw}
+	case 7:
+		return flusherHijackerPusherResponseWriter{rw}
+	case 8:
+		return closeNotifierResponseWriter{rw}
+	case 9:
+		return flusherCloseNotifierResponseWriter{rw}
+	case 10:
+		return hijackerCloseNotifierResponseWriter{rw}
+	case 11:
+		// fl, hj, cn, no ps: a typical HTTP/1.1 server connection.
+		return http1ResponseWriter{rw}
+	case 12:
+		return pusherCloseNotifierResponseWriter{rw}
+	case 13:
+		// fl, ps, cn, no hj: a real HTTP/2 connection, which intentionally
+		// never supports Hijack (see net/http.Hijacker's doc comment).
+		return http2ResponseWriter{rw}
+	case 14:
+		return hijackerPusherCloseNotifierResponseWriter{rw}
+	default: // 15
+		return fullResponseWriter{rw}
+	}
+}
+
+// Header simply returns the real http.ResponseWriter's Header.
+func (w *responseWriter) Header() http.Header {
+	return w.w.Header()
+}
+
+// Write buffers response writes so the recoverMux can throw them away in case
+// the real handler panics, unless the buffer has already been flushed to the
+// client, in which case it writes straight through.
+func (w *responseWriter) Write(p []byte) (int, error) {
+	if w.flushed {
+		return w.w.Write(p)
+	}
+	return w.buf.Write(p)
+}
+
+// WriteHeader saves the status code from the real handler so it can be thrown
+// away if the real handler panics. It panics if the code is not valid. Once
+// the response has been flushed, it is passed straight through instead.
+func (w *responseWriter) WriteHeader(statusCode int) {
+	if statusCode < 100 || statusCode > 999 {
+		panic(fmt.Sprintf("invalid WriteHeader code %v", statusCode))
+	}
+	if w.flushed {
+		w.w.WriteHeader(statusCode)
+		return
+	}
+	w.sc = statusCode
+}
+
+// Complete sends the full response to the client in cases where the real
+// handler completes without panicking. It is a no-op if the response was
+// already committed by a Flush.
+func (w *responseWriter) complete() error {
+	if w.flushed {
+		return nil
+	}
+	if w.sc > 0 {
+		w.w.WriteHeader(w.sc)
+	}
+	_, err := w.w.Write(w.buf.Bytes())
+	return err
+}
+
+// flush commits the buffered status code and body to the underlying writer
+// and switches w to pass-through mode, then flushes the underlying writer.
+//
+// Once flushed, a later panic in the wrapped handler can no longer be masked:
+// the buffered response has already been sent, so the recover handler's
+// response (if any) is appended after it rather than replacing it.
+func (w *responseWriter) flush() {
+	if !w.flushed {
+		if w.sc > 0 {
+			w.w.WriteHeader(w.sc)
+		}
+		w.w.Write(w.buf.Bytes())
+		w.buf.Reset()
+		w.flushed = true
+	}
+	w.w.(http.Flusher).Flush()
+}
+
+func (w *responseWriter) hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.w.(http.Hijacker).Hijack()
+}
+
+func (w *responseWriter) push(target string, opts *http.PushOptions) error {
+	return w.w.(http.Pusher).Push(target, opts)
+}
+
+func (w *responseWriter) closeNotify() <-chan bool {
+	return w.w.(http.CloseNotifier).CloseNotify()
+}
+
+// The following types each embed *responseWriter and add Flush/Hijack/
+// Push/CloseNotify in every combination, so wrapResponseWriter can return a
+// value whose method set exactly matches what the underlying
+// http.ResponseWriter supports. Names spell out their supported interfaces
+// in http.Flusher, http.Hijacker, http.Pusher, http.CloseNotifier order;
+// http1ResponseWriter and http2ResponseWriter are aliases (by shape, not by
+// declaration) for the two combinations real stdlib connections present.
+
+// flusherResponseWriter adds http.Flusher support to responseWriter.
+type flusherResponseWriter struct {
+	*responseWriter
+}
+
+func (w flusherResponseWriter) Flush() { w.flush() }
+
+// hijackerResponseWriter adds http.Hijacker support to responseWriter.
+type hijackerResponseWriter struct {
+	*responseWriter
+}
+
+func (w hijackerResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.hijack()
+}
+
+// pusherResponseWriter adds http.Pusher support to responseWriter.
+type pusherResponseWriter struct {
+	*responseWriter
+}
+
+func (w pusherResponseWriter) Push(target string, opts *http.PushOptions) error {
+	return w.push(target, opts)
+}
+
+// closeNotifierResponseWriter adds http.CloseNotifier support to
+// responseWriter.
+type closeNotifierResponseWriter struct {
+	*responseWriter
+}
+
+func (w closeNotifierResponseWriter) CloseNotify() <-chan bool {
+	return w.closeNotify()
+}
+
+// flusherHijackerResponseWriter adds http.Flusher and http.Hijacker support
+// to responseWriter.
+type flusherHijackerResponseWriter struct {
+	*responseWriter
+}
+
+func (w flusherHijackerResponseWriter) Flush() { w.flush() }
+
+func (w flusherHijackerResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.hijack()
+}
+
+// flusherPusherResponseWriter adds http.Flusher and http.Pusher support to
+// responseWriter.
+type flusherPusherResponseWriter struct {
+	*responseWriter
+}
+
+func (w flusherPusherResponseWriter) Flush() { w.flush() }
+
+func (w flusherPusherResponseWriter) Push(target string, opts *http.PushOptions) error {
+	return w.push(target, opts)
+}
+
+// flusherCloseNotifierResponseWriter adds http.Flusher and
+// http.CloseNotifier support to responseWriter.
+type flusherCloseNotifierResponseWriter struct {
+	*responseWriter
+}
+
+func (w flusherCloseNotifierResponseWriter) Flush() { w.flush() }
+
+func (w flusherCloseNotifierResponseWriter) CloseNotify() <-chan bool {
+	return w.closeNotify()
+}
+
+// hijackerPusherResponseWriter adds http.Hijacker and http.Pusher support to
+// responseWriter.
+type hijackerPusherResponseWriter struct {
+	*responseWriter
+}
+
+func (w hijackerPusherResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.hijack()
+}
+
+func (w hijackerPusherResponseWriter) Push(target string, opts *http.PushOptions) error {
+	return w.push(target, opts)
+}
+
+// hijackerCloseNotifierResponseWriter adds http.Hijacker and
+// http.CloseNotifier support to responseWriter.
+type hijackerCloseNotifierResponseWriter struct {
+	*responseWriter
+}
+
+func (w hijackerCloseNotifierResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.hijack()
+}
+
+func (w hijackerCloseNotifierResponseWriter) CloseNotify() <-chan bool {
+	return w.closeNotify()
+}
+
+// pusherCloseNotifierResponseWriter adds http.Pusher and http.CloseNotifier
+// support to responseWriter.
+type pusherCloseNotifierResponseWriter struct {
+	*responseWriter
+}
+
+func (w pusherCloseNotifierResponseWriter) Push(target string, opts *http.PushOptions) error {
+	return w.push(target, opts)
+}
+
+func (w pusherCloseNotifierResponseWriter) CloseNotify() <-chan bool {
+	return w.closeNotify()
+}
+
+// http1ResponseWriter adds http.Flusher, http.Hijacker, and
+// http.CloseNotifier support to responseWriter, matching a typical HTTP/1.1
+// server connection (no http.Pusher).
+type http1ResponseWriter struct {
+	*responseWriter
+}
+
+func (w http1ResponseWriter) Flush() { w.flush() }
+
+func (w http1ResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.hijack()
+}
+
+func (w http1ResponseWriter) CloseNotify() <-chan bool {
+	return w.closeNotify()
+}
+
+// http2ResponseWriter adds http.Flusher, http.Pusher, and http.CloseNotifier
+// support to responseWriter, matching a real HTTP/2 server connection (no
+// http.Hijacker).
+type http2ResponseWriter struct {
+	*responseWriter
+}
+
+func (w http2ResponseWriter) Flush() { w.flush() }
+
+func (w http2ResponseWriter) Push(target string, opts *http.PushOptions) error {
+	return w.push(target, opts)
+}
+
+func (w http2ResponseWriter) CloseNotify() <-chan bool {
+	return w.closeNotify()
+}
+
+// flusherHijackerPusherResponseWriter adds http.Flusher, http.Hijacker, and
+// http.Pusher support to responseWriter.
+type flusherHijackerPusherResponseWriter struct {
+	*responseWriter
+}
+
+func (w flusherHijackerPusherResponseWriter) Flush() { w.flush() }
+
+func (w flusherHijackerPusherResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.hijack()
+}
+
+func (w flusherHijackerPusherResponseWriter) Push(target string, opts *http.PushOptions) error {
+	return w.push(target, opts)
+}
+
+// hijackerPusherCloseNotifierResponseWriter adds http.Hijacker, http.Pusher,
+// and http.CloseNotifier support to responseWriter.
+type hijackerPusherCloseNotifierResponseWriter struct {
+	*responseWriter
+}
+
+func (w hijackerPusherCloseNotifierResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.hijack()
+}
+
+func (w hijackerPusherCloseNotifierResponseWriter) Push(target string, opts *http.PushOptions) error {
+	return w.push(target, opts)
+}
+
+func (w hijackerPusherCloseNotifierResponseWriter) CloseNotify() <-chan bool {
+	return w.closeNotify()
+}
+
+// fullResponseWriter adds http.Flusher, http.Hijacker, http.Pusher, and
+// http.CloseNotifier support to responseWriter. Real servers don't pair
+// Hijacker with Pusher (HTTP/1.1 supports Hijack but not Push; HTTP/2
+// supports Push but not Hijack), but this case is kept for completeness in
+// case a non-stdlib http.ResponseWriter implements all four.
+type fullResponseWriter struct {
+	*responseWriter
+}
+
+func (w fullResponseWriter) Flush() { w.flush() }
+
+func (w fullResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.hijack()
+}
+
+func (w fullResponseWriter) Push(target string, opts *http.PushOptions) error {
+	return w.push(target, opts)
+}
+
+func (w fullResponseWriter) CloseNotify() <-chan bool {
+	return w.closeNotify()
+}
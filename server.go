@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// errAlreadyServing is returned by Serve if rmux has already served from a
+// prior Serve or ListenAndServe call, even one since shut down; a RecoverMux
+// only manages one server.
+var errAlreadyServing = errors.New("recover: RecoverMux is already serving")
+
+// Serve accepts incoming connections on l, serving each with rmux until
+// Shutdown is called or l returns a permanent error, mirroring
+// http.Server.Serve. A RecoverMux serves only once: a later Serve returns
+// errAlreadyServing, also after Shutdown.
+func (rmux *RecoverMux) Serve(l net.Listener) error {
+	rmux.mu.Lock()
+	if rmux.srv != nil {
+		rmux.mu.Unlock()
+		return errAlreadyServing
+	}
+	srv := &http.Server{Handler: rmux}
+	rmux.srv = srv
+	close(rmux.ready)
+	rmux.mu.Unlock()
+
+	return srv.Serve(l)
+}
+
+// ListenAndServe listens on addr and calls Serve to handle requests,
+// mirroring http.Server.ListenAndServe.
+func (rmux *RecoverMux) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return rmux.Serve(l)
+}
+
+// Shutdown gracefully shuts down the server started by Serve or
+// ListenAndServe: it stops accepting new connections and waits for in-flight
+// handlers to finish, mirroring http.Server.Shutdown. If Serve was started
+// concurrently (e.g. via "go rmux.Serve(l)") and hasn't reached the point of
+// registering its server yet, Shutdown waits for it to do so rather than
+// racing it; it returns ctx.Err() if ctx is done first. If Serve was never
+// called, Shutdown blocks until ctx is done.
+func (rmux *RecoverMux) Shutdown(ctx context.Context) error {
+	select {
+	case <-rmux.ready:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	rmux.mu.Lock()
+	srv := rmux.srv
+	rmux.mu.Unlock()
+
+	return srv.Shutdown(ctx)
+}
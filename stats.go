@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// PanicRateLimit configures RecoverMux's panic circuit breaker. Once a
+// pattern panics Threshold times within Window, further requests to that
+// pattern are short-circuited with a 503 response for CoolDown instead of
+// invoking the handler again.
+type PanicRateLimit struct {
+	Threshold int
+	Window    time.Duration
+	CoolDown  time.Duration
+}
+
+// routeStats tracks the panics recovered for a single registered pattern.
+type routeStats struct {
+	total         int
+	lastPanicTime time.Time
+	lastStack     []byte
+
+	recentPanics     []time.Time // panic times within PanicRateLimit.Window, oldest first
+	circuitOpenUntil time.Time
+}
+
+// PanicStats is a point-in-time snapshot of the panics a RecoverMux has
+// recovered from, returned by RecoverMux.Stats.
+type PanicStats struct {
+	Total         int            `json:"total"`
+	Patterns      map[string]int `json:"patterns"`
+	LastPanicTime time.Time      `json:"last_panic_time,omitempty"`
+	LastStack     string         `json:"last_stack,omitempty"`
+}
+
+// Stats returns a snapshot of the panics rmux has recovered from, broken
+// down by registered pattern.
+func (rmux *RecoverMux) Stats() PanicStats {
+	rmux.mu.Lock()
+	defer rmux.mu.Unlock()
+
+	snap := PanicStats{Patterns: make(map[string]int, len(rmux.stats))}
+	for pattern, rs := range rmux.stats {
+		snap.Patterns[pattern] = rs.total
+		snap.Total += rs.total
+		if rs.lastPanicTime.After(snap.LastPanicTime) {
+			snap.LastPanicTime = rs.lastPanicTime
+			snap.LastStack = string(rs.lastStack)
+		}
+	}
+	return snap
+}
+
+// debugHandler renders Stats as JSON, for mounting at /debug/recover.
+func (rmux *RecoverMux) debugHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(rmux.Stats())
+	})
+}
+
+// routeStatsFor returns the routeStats for pattern, creating it if necessary.
+func (rmux *RecoverMux) routeStatsFor(pattern string) *routeStats {
+	rmux.mu.Lock()
+	defer rmux.mu.Unlock()
+
+	rs, ok := rmux.stats[pattern]
+	if !ok {
+		rs = &routeStats{}
+		rmux.stats[pattern] = rs
+	}
+	return rs
+}
+
+// recordPanic records a panic recovered while serving pattern and, if
+// PanicRateLimit is configured, updates the circuit breaker for pattern.
+func (rmux *RecoverMux) recordPanic(pattern string, stack []byte) {
+	rs := rmux.routeStatsFor(pattern)
+	now := time.Now()
+
+	rmux.mu.Lock()
+	defer rmux.mu.Unlock()
+
+	rs.total++
+	rs.lastPanicTime = now
+	rs.lastStack = stack
+
+	rl := rmux.PanicRateLimit
+	if rl == nil {
+		return
+	}
+
+	cutoff := now.Add(-rl.Window)
+	recent := rs.recentPanics[:0]
+	for _, t := range rs.recentPanics {
+		if t.After(cutoff) {
+			recent = append(recent, t)
+		}
+	}
+	rs.recentPanics = append(recent, now)
+
+	if len(rs.recentPanics) >= rl.Threshold {
+		rs.circuitOpenUntil = now.Add(rl.CoolDown)
+		rs.recentPanics = nil
+	}
+}
+
+// circuitOpen reports whether pattern's circuit breaker is currently open,
+// i.e. whether requests to it should be short-circuited without invoking the
+// handler.
+func (rmux *RecoverMux) circuitOpen(pattern string) bool {
+	rmux.mu.Lock()
+	defer rmux.mu.Unlock()
+
+	rs, ok := rmux.stats[pattern]
+	if !ok {
+		return false
+	}
+	return time.Now().Before(rs.circuitOpenUntil)
+}